@@ -0,0 +1,490 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// quoteAmountBucketSize is the granularity quotes are cached at; two
+	// requested amounts that fall into the same bucket share a cache
+	// entry instead of each triggering their own round trip to the swap
+	// servers.
+	quoteAmountBucketSize = btcutil.Amount(100_000)
+
+	// defaultQuoteCacheTTL is how long a cached quote is served before
+	// it's considered stale and re-fetched.
+	defaultQuoteCacheTTL = 30 * time.Second
+
+	// quoteDeadlineBucketSize is the granularity swapPublicationDeadline
+	// is cached at. It affects the quoted fee, so it's folded into the
+	// loop-out cache key alongside the amount bucket, rounded to this
+	// size so that requests a few seconds apart still share a cache
+	// entry.
+	quoteDeadlineBucketSize = 10 * time.Minute
+)
+
+// QuoteSelectionPolicy ranks a set of quotes gathered from multiple swap
+// server backends and picks the one a QuoteProvider should return to the
+// caller. Users can supply their own policy to NewQuoteProvider to rank
+// quotes by, for example, lowest prepay or shortest CLTV delta instead of
+// the default lowest total fee.
+type QuoteSelectionPolicy interface {
+	// SelectLoopOutQuote picks the best quote out of quotes, which is
+	// always non-empty.
+	SelectLoopOutQuote(quotes []*LoopOutQuote) *LoopOutQuote
+
+	// SelectLoopInQuote picks the best quote out of quotes, which is
+	// always non-empty.
+	SelectLoopInQuote(quotes []*LoopInQuote) *LoopInQuote
+}
+
+// lowestFeePolicy is the default QuoteSelectionPolicy. It selects the quote
+// with the lowest total swap fee, breaking ties by the shortest CLTV delta.
+type lowestFeePolicy struct{}
+
+var _ QuoteSelectionPolicy = (*lowestFeePolicy)(nil)
+
+func (lowestFeePolicy) SelectLoopOutQuote(
+	quotes []*LoopOutQuote) *LoopOutQuote {
+
+	best := quotes[0]
+	for _, quote := range quotes[1:] {
+		cost, bestCost := quote.SwapFee+quote.PrepayAmount,
+			best.SwapFee+best.PrepayAmount
+
+		switch {
+		case cost < bestCost:
+			best = quote
+
+		case cost == bestCost && quote.CltvDelta < best.CltvDelta:
+			best = quote
+		}
+	}
+
+	return best
+}
+
+func (lowestFeePolicy) SelectLoopInQuote(
+	quotes []*LoopInQuote) *LoopInQuote {
+
+	best := quotes[0]
+	for _, quote := range quotes[1:] {
+		switch {
+		case quote.SwapFee < best.SwapFee:
+			best = quote
+
+		case quote.SwapFee == best.SwapFee &&
+			quote.CltvDelta < best.CltvDelta:
+
+			best = quote
+		}
+	}
+
+	return best
+}
+
+// loopOutCacheKey identifies a cached loop-out quote. swapPublicationDeadline
+// affects the quoted fee, so it must be part of the key alongside the
+// amount bucket, or a cache hit could silently hand back a quote for the
+// wrong deadline.
+type loopOutCacheKey struct {
+	bucket         btcutil.Amount
+	deadlineBucket time.Time
+}
+
+// loopOutCacheEntry holds a cached loop-out quote and when it was fetched.
+type loopOutCacheEntry struct {
+	quote     *LoopOutQuote
+	fetchedAt time.Time
+}
+
+// loopInCacheEntry holds a cached loop-in quote and when it was fetched.
+type loopInCacheEntry struct {
+	quote     *LoopInQuote
+	fetchedAt time.Time
+}
+
+// quoteBucket rounds amt down to the nearest cache bucket boundary, so that
+// requests for similar amounts share a cache entry.
+func quoteBucket(amt btcutil.Amount) btcutil.Amount {
+	return (amt / quoteAmountBucketSize) * quoteAmountBucketSize
+}
+
+// quoteDeadlineBucket rounds deadline down to the nearest cache bucket
+// boundary, so that requests a few seconds apart share a cache entry.
+func quoteDeadlineBucket(deadline time.Time) time.Time {
+	return deadline.Truncate(quoteDeadlineBucketSize)
+}
+
+// QuoteProvider wraps one or more swapServerClient backends. It caches their
+// terms and quotes for a configurable TTL and, when more than one backend is
+// configured, fans a request out to all of them in parallel, either merging
+// the results (terms) or picking the best one according to its
+// QuoteSelectionPolicy (quotes).
+type QuoteProvider struct {
+	clients  []swapServerClient
+	policy   QuoteSelectionPolicy
+	cacheTTL time.Duration
+
+	mu sync.Mutex
+
+	loopOutCache map[loopOutCacheKey]*loopOutCacheEntry
+	loopInCache  map[btcutil.Amount]*loopInCacheEntry
+
+	loopOutTerms          *LoopOutTerms
+	loopOutTermsFetchedAt time.Time
+
+	loopInTerms          *LoopInTerms
+	loopInTermsFetchedAt time.Time
+}
+
+// NewQuoteProvider creates a QuoteProvider backed by clients, ranking quotes
+// gathered from them with policy. If policy is nil, quotes are ranked by
+// lowest total fee. If cacheTTL is zero, defaultQuoteCacheTTL is used.
+func NewQuoteProvider(clients []swapServerClient,
+	policy QuoteSelectionPolicy, cacheTTL time.Duration) *QuoteProvider {
+
+	if policy == nil {
+		policy = lowestFeePolicy{}
+	}
+	if cacheTTL == 0 {
+		cacheTTL = defaultQuoteCacheTTL
+	}
+
+	return &QuoteProvider{
+		clients:      clients,
+		policy:       policy,
+		cacheTTL:     cacheTTL,
+		loopOutCache: make(map[loopOutCacheKey]*loopOutCacheEntry),
+		loopInCache:  make(map[btcutil.Amount]*loopInCacheEntry),
+	}
+}
+
+// GetLoopOutTerms returns the loop out terms for this provider's backends,
+// serving a cached result if one is still fresh. When multiple backends are
+// configured, the returned terms are the intersection of those of every
+// backend that answered; backends whose call failed are left out of it. An
+// error is returned only if no backend answered.
+func (p *QuoteProvider) GetLoopOutTerms(ctx context.Context) (
+	*LoopOutTerms, error) {
+
+	p.mu.Lock()
+	if p.loopOutTerms != nil &&
+		time.Since(p.loopOutTermsFetchedAt) < p.cacheTTL {
+
+		terms := p.loopOutTerms
+		p.mu.Unlock()
+		return terms, nil
+	}
+	p.mu.Unlock()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []*LoopOutTerms
+		lastErr error
+	)
+	for _, client := range p.clients {
+		client := client
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			terms, err := client.GetLoopOutTerms(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			results = append(results, terms)
+		}()
+	}
+	wg.Wait()
+
+	if len(results) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+
+		return nil, errors.New("no swap server backends configured")
+	}
+
+	terms := intersectLoopOutTerms(results)
+
+	p.mu.Lock()
+	p.loopOutTerms = terms
+	p.loopOutTermsFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	return terms, nil
+}
+
+// GetLoopInTerms returns the loop in terms for this provider's backends,
+// serving a cached result if one is still fresh. When multiple backends are
+// configured, the returned terms are the intersection of those of every
+// backend that answered; backends whose call failed are left out of it. An
+// error is returned only if no backend answered.
+func (p *QuoteProvider) GetLoopInTerms(ctx context.Context) (
+	*LoopInTerms, error) {
+
+	p.mu.Lock()
+	if p.loopInTerms != nil &&
+		time.Since(p.loopInTermsFetchedAt) < p.cacheTTL {
+
+		terms := p.loopInTerms
+		p.mu.Unlock()
+		return terms, nil
+	}
+	p.mu.Unlock()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results []*LoopInTerms
+		lastErr error
+	)
+	for _, client := range p.clients {
+		client := client
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			terms, err := client.GetLoopInTerms(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			results = append(results, terms)
+		}()
+	}
+	wg.Wait()
+
+	if len(results) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+
+		return nil, errors.New("no swap server backends configured")
+	}
+
+	terms := intersectLoopInTerms(results)
+
+	p.mu.Lock()
+	p.loopInTerms = terms
+	p.loopInTermsFetchedAt = time.Now()
+	p.mu.Unlock()
+
+	return terms, nil
+}
+
+// intersectLoopOutTerms narrows terms down to the range every backend
+// agrees on, so that any amount within it is valid regardless of which
+// backend ends up servicing the swap.
+func intersectLoopOutTerms(terms []*LoopOutTerms) *LoopOutTerms {
+	best := &LoopOutTerms{
+		MinSwapAmount: terms[0].MinSwapAmount,
+		MaxSwapAmount: terms[0].MaxSwapAmount,
+	}
+	for _, t := range terms[1:] {
+		if t.MinSwapAmount > best.MinSwapAmount {
+			best.MinSwapAmount = t.MinSwapAmount
+		}
+		if t.MaxSwapAmount < best.MaxSwapAmount {
+			best.MaxSwapAmount = t.MaxSwapAmount
+		}
+	}
+
+	return best
+}
+
+// intersectLoopInTerms narrows terms down to the range every backend agrees
+// on, so that any amount within it is valid regardless of which backend
+// ends up servicing the swap.
+func intersectLoopInTerms(terms []*LoopInTerms) *LoopInTerms {
+	best := &LoopInTerms{
+		MinSwapAmount: terms[0].MinSwapAmount,
+		MaxSwapAmount: terms[0].MaxSwapAmount,
+	}
+	for _, t := range terms[1:] {
+		if t.MinSwapAmount > best.MinSwapAmount {
+			best.MinSwapAmount = t.MinSwapAmount
+		}
+		if t.MaxSwapAmount < best.MaxSwapAmount {
+			best.MaxSwapAmount = t.MaxSwapAmount
+		}
+	}
+
+	return best
+}
+
+// GetLoopOutQuote returns the best loop out quote for amt across all
+// configured swap server backends, serving a cached result if one is still
+// fresh.
+func (p *QuoteProvider) GetLoopOutQuote(ctx context.Context,
+	amt btcutil.Amount, swapPublicationDeadline time.Time) (
+	*LoopOutQuote, error) {
+
+	key := loopOutCacheKey{
+		bucket:         quoteBucket(amt),
+		deadlineBucket: quoteDeadlineBucket(swapPublicationDeadline),
+	}
+
+	if quote := p.cachedLoopOut(key); quote != nil {
+		return quote, nil
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		quotes  []*LoopOutQuote
+		lastErr error
+	)
+	for _, client := range p.clients {
+		client := client
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			quote, err := client.GetLoopOutQuote(
+				ctx, amt, swapPublicationDeadline,
+			)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			quotes = append(quotes, quote)
+		}()
+	}
+	wg.Wait()
+
+	if len(quotes) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+
+		return nil, errors.New("no swap server backends configured")
+	}
+
+	best := p.policy.SelectLoopOutQuote(quotes)
+	p.storeLoopOut(key, best)
+
+	return best, nil
+}
+
+// GetLoopInQuote returns the best loop in quote for amt across all
+// configured swap server backends, serving a cached result if one is still
+// fresh.
+func (p *QuoteProvider) GetLoopInQuote(ctx context.Context,
+	amt btcutil.Amount) (*LoopInQuote, error) {
+
+	bucket := quoteBucket(amt)
+
+	if quote := p.cachedLoopIn(bucket); quote != nil {
+		return quote, nil
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		quotes  []*LoopInQuote
+		lastErr error
+	)
+	for _, client := range p.clients {
+		client := client
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			quote, err := client.GetLoopInQuote(ctx, amt)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			quotes = append(quotes, quote)
+		}()
+	}
+	wg.Wait()
+
+	if len(quotes) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+
+		return nil, errors.New("no swap server backends configured")
+	}
+
+	best := p.policy.SelectLoopInQuote(quotes)
+	p.storeLoopIn(bucket, best)
+
+	return best, nil
+}
+
+// cachedLoopOut returns the cached loop-out quote for key, or nil if there
+// is none or it has expired.
+func (p *QuoteProvider) cachedLoopOut(key loopOutCacheKey) *LoopOutQuote {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.loopOutCache[key]
+	if !ok || time.Since(entry.fetchedAt) >= p.cacheTTL {
+		return nil
+	}
+
+	return entry.quote
+}
+
+// cachedLoopIn returns the cached loop-in quote for bucket, or nil if there
+// is none or it has expired.
+func (p *QuoteProvider) cachedLoopIn(bucket btcutil.Amount) *LoopInQuote {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.loopInCache[bucket]
+	if !ok || time.Since(entry.fetchedAt) >= p.cacheTTL {
+		return nil
+	}
+
+	return entry.quote
+}
+
+// storeLoopOut caches quote as the loop-out quote for key.
+func (p *QuoteProvider) storeLoopOut(key loopOutCacheKey, quote *LoopOutQuote) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loopOutCache[key] = &loopOutCacheEntry{
+		quote:     quote,
+		fetchedAt: time.Now(),
+	}
+}
+
+// storeLoopIn caches quote as the loop-in quote for bucket.
+func (p *QuoteProvider) storeLoopIn(bucket btcutil.Amount, quote *LoopInQuote) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loopInCache[bucket] = &loopInCacheEntry{
+		quote:     quote,
+		fetchedAt: time.Now(),
+	}
+}
@@ -0,0 +1,117 @@
+package loop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuoteBucket asserts that amounts are rounded down to their cache
+// bucket boundary.
+func TestQuoteBucket(t *testing.T) {
+	tests := []struct {
+		amt  btcutil.Amount
+		want btcutil.Amount
+	}{
+		{amt: 0, want: 0},
+		{amt: 50_000, want: 0},
+		{amt: 100_000, want: 100_000},
+		{amt: 150_000, want: 100_000},
+		{amt: 999_999, want: 900_000},
+	}
+
+	for _, tc := range tests {
+		require.Equal(t, tc.want, quoteBucket(tc.amt))
+	}
+}
+
+// TestQuoteCacheDoesNotClobberOtherKind is a regression test for caching a
+// loop-in quote overwriting an already-cached loop-out quote (or vice
+// versa) for the same amount bucket.
+func TestQuoteCacheDoesNotClobberOtherKind(t *testing.T) {
+	p := NewQuoteProvider(nil, nil, time.Minute)
+
+	bucket := quoteBucket(100_000)
+	key := loopOutCacheKey{bucket: bucket}
+	outQuote := &LoopOutQuote{SwapFee: 1}
+	inQuote := &LoopInQuote{SwapFee: 2}
+
+	p.storeLoopOut(key, outQuote)
+	require.Equal(t, outQuote, p.cachedLoopOut(key))
+
+	p.storeLoopIn(bucket, inQuote)
+	require.Equal(t, inQuote, p.cachedLoopIn(bucket))
+
+	// Caching the loop-in quote must not have evicted the loop-out quote
+	// cached just before it.
+	require.Equal(t, outQuote, p.cachedLoopOut(key))
+}
+
+// TestQuoteCacheExpires asserts that a cached quote is no longer served
+// once its TTL has elapsed.
+func TestQuoteCacheExpires(t *testing.T) {
+	p := NewQuoteProvider(nil, nil, time.Millisecond)
+
+	key := loopOutCacheKey{bucket: quoteBucket(100_000)}
+	p.storeLoopOut(key, &LoopOutQuote{SwapFee: 1})
+
+	time.Sleep(5 * time.Millisecond)
+
+	require.Nil(t, p.cachedLoopOut(key))
+}
+
+// TestQuoteCacheKeysByDeadline asserts that loop-out quotes cached for
+// different swapPublicationDeadline values don't collide, even when the
+// amount bucket is the same.
+func TestQuoteCacheKeysByDeadline(t *testing.T) {
+	p := NewQuoteProvider(nil, nil, time.Minute)
+
+	bucket := quoteBucket(100_000)
+	deadlineA := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	deadlineB := deadlineA.Add(time.Hour)
+
+	keyA := loopOutCacheKey{
+		bucket:         bucket,
+		deadlineBucket: quoteDeadlineBucket(deadlineA),
+	}
+	keyB := loopOutCacheKey{
+		bucket:         bucket,
+		deadlineBucket: quoteDeadlineBucket(deadlineB),
+	}
+
+	quoteA := &LoopOutQuote{SwapFee: 1}
+	p.storeLoopOut(keyA, quoteA)
+
+	// A quote cached for a different deadline bucket must not be served
+	// for keyB, even though the amount bucket matches.
+	require.Nil(t, p.cachedLoopOut(keyB))
+	require.Equal(t, quoteA, p.cachedLoopOut(keyA))
+}
+
+// TestLowestFeePolicySelectsCheapestLoopOutQuote asserts that the default
+// policy picks the lowest total fee, breaking ties by CLTV delta.
+func TestLowestFeePolicySelectsCheapestLoopOutQuote(t *testing.T) {
+	policy := lowestFeePolicy{}
+
+	quotes := []*LoopOutQuote{
+		{SwapFee: 10, PrepayAmount: 5, CltvDelta: 100},
+		{SwapFee: 5, PrepayAmount: 5, CltvDelta: 200},
+		{SwapFee: 5, PrepayAmount: 5, CltvDelta: 50},
+	}
+
+	require.Equal(t, quotes[2], policy.SelectLoopOutQuote(quotes))
+}
+
+// TestIntersectLoopOutTerms asserts that intersecting terms from multiple
+// backends narrows the range to what every backend agrees on.
+func TestIntersectLoopOutTerms(t *testing.T) {
+	terms := []*LoopOutTerms{
+		{MinSwapAmount: 1_000, MaxSwapAmount: 1_000_000},
+		{MinSwapAmount: 2_000, MaxSwapAmount: 900_000},
+	}
+
+	want := &LoopOutTerms{MinSwapAmount: 2_000, MaxSwapAmount: 900_000}
+	require.Equal(t, want, intersectLoopOutTerms(terms))
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"time"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -14,10 +16,25 @@ import (
 	"github.com/lightninglabs/loop/looprpc"
 	"github.com/lightninglabs/loop/lsat"
 	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/proxy"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
+// swapUpdateStreamRetryWait is the amount of time we wait before trying to
+// re-establish a swap update subscription after the stream was interrupted.
+// It's declared as a var rather than a const so tests can shrink it.
+var swapUpdateStreamRetryWait = 5 * time.Second
+
+// swapUpdateStream is the subset of looprpc.SwapServer_SubscribeSwapUpdatesClient
+// used by runSwapUpdateStream, factored out so the receive loop can be
+// exercised in tests against a fake stream.
+type swapUpdateStream interface {
+	Recv() (*looprpc.SubscribeSwapUpdatesResponse, error)
+}
+
 type swapServerClient interface {
 	GetLoopOutTerms(ctx context.Context) (
 		*LoopOutTerms, error)
@@ -42,26 +59,158 @@ type swapServerClient interface {
 		swapHash lntypes.Hash, amount btcutil.Amount,
 		senderKey [33]byte, swapInvoice string) (
 		*newLoopInResponse, error)
+
+	// SubscribeSwapUpdates opens a long-lived, server-streamed
+	// subscription for status updates the swap server pushes for the
+	// swap identified by swapHash (HTLC seen, preimage revealed, refund
+	// broadcast, etc). An interrupted stream is re-established once
+	// after a short wait. The returned channel is closed when ctx is
+	// canceled, when the server ends the stream normally, or when
+	// re-establishing an interrupted stream fails.
+	SubscribeSwapUpdates(ctx context.Context,
+		swapHash lntypes.Hash) (<-chan SwapUpdate, error)
+}
+
+// SwapUpdate is a single server-pushed status update for an in-flight swap.
+type SwapUpdate struct {
+	// State is the swap server's view of the swap's current state.
+	State string
+
+	// Timestamp is the time the swap server recorded this update.
+	Timestamp time.Time
 }
 
 type grpcSwapServerClient struct {
-	server looprpc.SwapServerClient
-	conn   *grpc.ClientConn
+	server   looprpc.SwapServerClient
+	conn     *grpc.ClientConn
+	retryCfg retryConfig
 }
 
 var _ swapServerClient = (*grpcSwapServerClient)(nil)
 
+// swapServerClientConfig holds the options newSwapServerClient can be
+// customized with, on top of its required arguments.
+type swapServerClientConfig struct {
+	// retryCfg is the retry policy used for unary swap server calls.
+	retryCfg retryConfig
+
+	// proxyAddress is the address of a SOCKS5 proxy the swap server
+	// connection should be dialed through, e.g. to reach a .onion
+	// endpoint. Empty means no proxy is used.
+	proxyAddress string
+
+	// proxyAuth holds the SOCKS5 credentials to use against proxyAddress,
+	// if the proxy requires authentication.
+	proxyAuth *proxy.Auth
+
+	// registerer, if set, is used to register Prometheus metrics for
+	// every unary call made to the swap server.
+	registerer prometheus.Registerer
+
+	// tracerProvider, if set, is used to create OpenTelemetry spans for
+	// every unary call made to the swap server.
+	tracerProvider trace.TracerProvider
+
+	// metrics, if set, is used instead of creating a fresh
+	// swapServerMetrics from registerer. This lets newSwapServerClients
+	// share a single set of collectors across every backend it
+	// constructs, instead of each one registering its own and colliding
+	// with the others.
+	metrics *swapServerMetrics
+}
+
+// swapServerClientOption customizes the behavior of a grpcSwapServerClient
+// created through newSwapServerClient.
+type swapServerClientOption func(*swapServerClientConfig)
+
+// withRetryConfig overrides the default retry policy used for unary swap
+// server calls.
+func withRetryConfig(cfg retryConfig) swapServerClientOption {
+	return func(cfg2 *swapServerClientConfig) {
+		cfg2.retryCfg = cfg
+	}
+}
+
+// withProxy routes the swap server connection through the SOCKS5 proxy
+// listening at proxyAddress, e.g. a local Tor daemon, so that the swap
+// server can be reached at a .onion address or from behind a corporate
+// proxy. username and password may be left empty if the proxy doesn't
+// require authentication.
+func withProxy(proxyAddress, username, password string) swapServerClientOption {
+	return func(cfg *swapServerClientConfig) {
+		cfg.proxyAddress = proxyAddress
+
+		if username != "" {
+			cfg.proxyAuth = &proxy.Auth{
+				User:     username,
+				Password: password,
+			}
+		}
+	}
+}
+
+// withPrometheusRegisterer enables Prometheus metrics for every unary call
+// made to the swap server, registered with reg.
+func withPrometheusRegisterer(reg prometheus.Registerer) swapServerClientOption {
+	return func(cfg *swapServerClientConfig) {
+		cfg.registerer = reg
+	}
+}
+
+// withTracerProvider enables OpenTelemetry tracing for every unary call made
+// to the swap server, using tp to create spans.
+func withTracerProvider(tp trace.TracerProvider) swapServerClientOption {
+	return func(cfg *swapServerClientConfig) {
+		cfg.tracerProvider = tp
+	}
+}
+
+// withSwapServerMetrics pins the swapServerMetrics instance a
+// grpcSwapServerClient instruments its calls with, instead of having it
+// create its own from the configured Registerer. newSwapServerClients uses
+// this to share one set of collectors across every backend it constructs.
+func withSwapServerMetrics(metrics *swapServerMetrics) swapServerClientOption {
+	return func(cfg *swapServerClientConfig) {
+		cfg.metrics = metrics
+	}
+}
+
 func newSwapServerClient(address string, insecure bool, tlsPath string,
-	lsatStore lsat.Store, lnd *lndclient.LndServices) (
-	*grpcSwapServerClient, error) {
+	lsatStore lsat.Store, lnd *lndclient.LndServices,
+	opts ...swapServerClientOption) (*grpcSwapServerClient, error) {
+
+	cfg := &swapServerClientConfig{
+		retryCfg: defaultRetryConfig,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
 
 	// Create the server connection with the interceptor that will handle
-	// the LSAT protocol for us.
+	// the LSAT protocol for us, chained together with metrics and
+	// tracing interceptors if the caller asked for them.
 	clientInterceptor := lsat.NewInterceptor(
 		lnd, lsatStore, serverRPCTimeout,
 	)
+	interceptors := []grpc.UnaryClientInterceptor{
+		clientInterceptor.UnaryInterceptor,
+	}
+	if cfg.registerer != nil {
+		metrics := cfg.metrics
+		if metrics == nil {
+			metrics = newSwapServerMetrics(cfg.registerer)
+		}
+		interceptors = append(interceptors, metrics.unaryInterceptor())
+	}
+	if cfg.tracerProvider != nil {
+		interceptors = append(
+			interceptors, tracingInterceptor(cfg.tracerProvider),
+		)
+	}
+
 	serverConn, err := getSwapServerConn(
-		address, insecure, tlsPath, clientInterceptor,
+		address, insecure, tlsPath, cfg.proxyAddress, cfg.proxyAuth,
+		interceptors,
 	)
 	if err != nil {
 		return nil, err
@@ -70,19 +219,66 @@ func newSwapServerClient(address string, insecure bool, tlsPath string,
 	server := looprpc.NewSwapServerClient(serverConn)
 
 	return &grpcSwapServerClient{
-		conn:   serverConn,
-		server: server,
+		conn:     serverConn,
+		server:   server,
+		retryCfg: cfg.retryCfg,
 	}, nil
 }
 
+// newSwapServerClients builds a grpcSwapServerClient for every address in
+// addresses, sharing the same connection options. This is used by
+// QuoteProvider to fan quote requests out across multiple swap server
+// backends.
+func newSwapServerClients(addresses []string, insecure bool, tlsPath string,
+	lsatStore lsat.Store, lnd *lndclient.LndServices,
+	opts ...swapServerClientOption) ([]swapServerClient, error) {
+
+	// If metrics were requested, build the collectors once up front and
+	// pin every client to that one instance. Otherwise each client would
+	// try to register its own copy of the same collectors and panic on
+	// the second registration.
+	probeCfg := &swapServerClientConfig{retryCfg: defaultRetryConfig}
+	for _, opt := range opts {
+		opt(probeCfg)
+	}
+	if probeCfg.registerer != nil {
+		opts = append(opts, withSwapServerMetrics(
+			newSwapServerMetrics(probeCfg.registerer),
+		))
+	}
+
+	clients := make([]swapServerClient, 0, len(addresses))
+	for _, address := range addresses {
+		client, err := newSwapServerClient(
+			address, insecure, tlsPath, lsatStore, lnd, opts...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
 func (s *grpcSwapServerClient) GetLoopOutTerms(ctx context.Context) (
 	*LoopOutTerms, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	terms, err := s.server.LoopOutTerms(rpcCtx,
-		&looprpc.ServerLoopOutTermsRequest{},
-	)
+	var terms *looprpc.ServerLoopOutTermsResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+
+		resp, err := s.server.LoopOutTerms(rpcCtx,
+			&looprpc.ServerLoopOutTermsRequest{},
+		)
+		if err != nil {
+			return err
+		}
+		terms = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -97,14 +293,23 @@ func (s *grpcSwapServerClient) GetLoopOutQuote(ctx context.Context,
 	amt btcutil.Amount, swapPublicationDeadline time.Time) (
 	*LoopOutQuote, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	quoteResp, err := s.server.LoopOutQuote(rpcCtx,
-		&looprpc.ServerLoopOutQuoteRequest{
-			Amt:                     uint64(amt),
-			SwapPublicationDeadline: swapPublicationDeadline.Unix(),
-		},
-	)
+	var quoteResp *looprpc.ServerLoopOutQuoteResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+
+		resp, err := s.server.LoopOutQuote(rpcCtx,
+			&looprpc.ServerLoopOutQuoteRequest{
+				Amt:                     uint64(amt),
+				SwapPublicationDeadline: swapPublicationDeadline.Unix(),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		quoteResp = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -130,11 +335,20 @@ func (s *grpcSwapServerClient) GetLoopOutQuote(ctx context.Context,
 func (s *grpcSwapServerClient) GetLoopInTerms(ctx context.Context) (
 	*LoopInTerms, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	terms, err := s.server.LoopInTerms(rpcCtx,
-		&looprpc.ServerLoopInTermsRequest{},
-	)
+	var terms *looprpc.ServerLoopInTermsResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+
+		resp, err := s.server.LoopInTerms(rpcCtx,
+			&looprpc.ServerLoopInTermsRequest{},
+		)
+		if err != nil {
+			return err
+		}
+		terms = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -148,13 +362,22 @@ func (s *grpcSwapServerClient) GetLoopInTerms(ctx context.Context) (
 func (s *grpcSwapServerClient) GetLoopInQuote(ctx context.Context,
 	amt btcutil.Amount) (*LoopInQuote, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	quoteResp, err := s.server.LoopInQuote(rpcCtx,
-		&looprpc.ServerLoopInQuoteRequest{
-			Amt: uint64(amt),
-		},
-	)
+	var quoteResp *looprpc.ServerLoopInQuoteResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+
+		resp, err := s.server.LoopInQuote(rpcCtx,
+			&looprpc.ServerLoopInQuoteRequest{
+				Amt: uint64(amt),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		quoteResp = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -170,16 +393,26 @@ func (s *grpcSwapServerClient) NewLoopOutSwap(ctx context.Context,
 	receiverKey [33]byte, swapPublicationDeadline time.Time) (
 	*newLoopOutResponse, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	swapResp, err := s.server.NewLoopOutSwap(rpcCtx,
-		&looprpc.ServerLoopOutRequest{
-			SwapHash:                swapHash[:],
-			Amt:                     uint64(amount),
-			ReceiverKey:             receiverKey[:],
-			SwapPublicationDeadline: swapPublicationDeadline.Unix(),
-		},
-	)
+	var swapResp *looprpc.ServerLoopOutResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+		rpcCtx = outgoingCtxWithIdempotencyKey(rpcCtx, swapHash)
+
+		resp, err := s.server.NewLoopOutSwap(rpcCtx,
+			&looprpc.ServerLoopOutRequest{
+				SwapHash:                swapHash[:],
+				Amt:                     uint64(amount),
+				ReceiverKey:             receiverKey[:],
+				SwapPublicationDeadline: swapPublicationDeadline.Unix(),
+			},
+		)
+		if err != nil {
+			return err
+		}
+		swapResp = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -205,16 +438,26 @@ func (s *grpcSwapServerClient) NewLoopInSwap(ctx context.Context,
 	swapHash lntypes.Hash, amount btcutil.Amount, senderKey [33]byte,
 	swapInvoice string) (*newLoopInResponse, error) {
 
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
-	defer rpcCancel()
-	swapResp, err := s.server.NewLoopInSwap(rpcCtx,
-		&looprpc.ServerLoopInRequest{
-			SwapHash:    swapHash[:],
-			Amt:         uint64(amount),
-			SenderKey:   senderKey[:],
-			SwapInvoice: swapInvoice,
-		},
-	)
+	var swapResp *looprpc.ServerLoopInResponse
+	err := withRetry(ctx, s.retryCfg, func() error {
+		rpcCtx, rpcCancel := context.WithTimeout(ctx, globalCallTimeout)
+		defer rpcCancel()
+		rpcCtx = outgoingCtxWithIdempotencyKey(rpcCtx, swapHash)
+
+		resp, err := s.server.NewLoopInSwap(rpcCtx,
+			&looprpc.ServerLoopInRequest{
+				SwapHash:    swapHash[:],
+				Amt:         uint64(amount),
+				SenderKey:   senderKey[:],
+				SwapInvoice: swapInvoice,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		swapResp = resp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -234,18 +477,141 @@ func (s *grpcSwapServerClient) NewLoopInSwap(ctx context.Context,
 	}, nil
 }
 
+// SubscribeSwapUpdates opens a server-streaming RPC that the swap server uses
+// to push status updates for a single swap, and forwards them on the
+// returned channel. If the underlying stream is interrupted, it is
+// re-established automatically after swapUpdateStreamRetryWait, unless ctx
+// has been canceled. If re-establishing it fails, the returned channel is
+// closed and no further attempt is made.
+func (s *grpcSwapServerClient) SubscribeSwapUpdates(ctx context.Context,
+	swapHash lntypes.Hash) (<-chan SwapUpdate, error) {
+
+	reconnect := func(ctx context.Context) (swapUpdateStream, error) {
+		return s.server.SubscribeSwapUpdates(
+			ctx, &looprpc.SubscribeSwapUpdatesRequest{
+				SwapHash: swapHash[:],
+			},
+		)
+	}
+
+	stream, err := reconnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	updateChan := make(chan SwapUpdate)
+	go runSwapUpdateStream(ctx, updateChan, stream, reconnect)
+
+	return updateChan, nil
+}
+
+// runSwapUpdateStream drains stream into updateChan, translating each
+// message as it arrives. If the stream ends with io.EOF, the server has
+// finished it normally (the swap reached a terminal state) and updateChan is
+// closed without reconnecting. Any other error is treated as a transient
+// interruption: after swapUpdateStreamRetryWait the stream is re-established
+// via reconnect, unless ctx is canceled first.
+func runSwapUpdateStream(ctx context.Context, updateChan chan<- SwapUpdate,
+	stream swapUpdateStream,
+	reconnect func(ctx context.Context) (swapUpdateStream, error)) {
+
+	defer close(updateChan)
+
+	for {
+		update, err := stream.Recv()
+		switch {
+		case err == nil:
+			select {
+			case updateChan <- SwapUpdate{
+				State:     update.State,
+				Timestamp: time.Unix(update.Timestamp, 0),
+			}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+
+		case errors.Is(err, io.EOF):
+			// The server closed the stream normally, there is
+			// nothing left to subscribe to.
+			return
+
+		case ctx.Err() != nil:
+			return
+		}
+
+		// The stream was interrupted, most likely because the
+		// server restarted or a load balancer dropped the
+		// connection. Wait a bit and try to re-establish it
+		// rather than giving up on the subscription.
+		select {
+		case <-time.After(swapUpdateStreamRetryWait):
+		case <-ctx.Done():
+			return
+		}
+
+		stream, err = reconnect(ctx)
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (s *grpcSwapServerClient) Close() {
 	s.conn.Close()
 }
 
-// getSwapServerConn returns a connection to the swap server.
+// newSwapServerContextDialer builds a grpc.WithContextDialer func that
+// tunnels the swap server connection through a SOCKS5 proxy listening at
+// proxyAddress, which allows reaching a .onion swap server endpoint over Tor
+// or connecting out through a corporate proxy.
+func newSwapServerContextDialer(proxyAddress string, proxyAuth *proxy.Auth) (
+	func(ctx context.Context, addr string) (net.Conn, error), error) {
+
+	dialer, err := proxy.SOCKS5(
+		"tcp", proxyAddress, proxyAuth, proxy.Direct,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create SOCKS5 "+
+			"dialer: %v", err)
+	}
+
+	// proxy.SOCKS5 always returns a proxy.ContextDialer, which lets us
+	// honor ctx's deadline/cancellation for the SOCKS5 handshake itself,
+	// not just the TCP connect. Without this, a hung .onion handshake
+	// would only time out at the OS level.
+	contextDialer, ok := dialer.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New("SOCKS5 dialer does not " +
+			"support dialing with a context")
+	}
+
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		return contextDialer.DialContext(ctx, "tcp", addr)
+	}, nil
+}
+
+// getSwapServerConn returns a connection to the swap server. If proxyAddress
+// is set, the connection is dialed through a SOCKS5 proxy listening there,
+// which allows reaching a .onion swap server endpoint over Tor or connecting
+// out through a corporate proxy.
 func getSwapServerConn(address string, insecure bool, tlsPath string,
-	interceptor *lsat.Interceptor) (*grpc.ClientConn, error) {
+	proxyAddress string, proxyAuth *proxy.Auth,
+	interceptors []grpc.UnaryClientInterceptor) (*grpc.ClientConn, error) {
 
 	// Create a dial options array.
-	opts := []grpc.DialOption{grpc.WithUnaryInterceptor(
-		interceptor.UnaryInterceptor,
-	)}
+	opts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(interceptors...),
+	}
+
+	if proxyAddress != "" {
+		dial, err := newSwapServerContextDialer(proxyAddress, proxyAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, grpc.WithContextDialer(dial))
+	}
 
 	// There are three options to connect to a swap server, either insecure,
 	// using a self-signed certificate or with a certificate signed by a
@@ -0,0 +1,152 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lightninglabs/loop/looprpc"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSwapUpdateStream is a swapUpdateStream stub whose Recv results are
+// scripted via results.
+type fakeSwapUpdateStream struct {
+	results chan swapUpdateStreamResult
+}
+
+type swapUpdateStreamResult struct {
+	update *looprpc.SubscribeSwapUpdatesResponse
+	err    error
+}
+
+func newFakeSwapUpdateStream(results ...swapUpdateStreamResult) *fakeSwapUpdateStream {
+	stream := &fakeSwapUpdateStream{
+		results: make(chan swapUpdateStreamResult, len(results)),
+	}
+	for _, res := range results {
+		stream.results <- res
+	}
+
+	return stream
+}
+
+func (f *fakeSwapUpdateStream) Recv() (*looprpc.SubscribeSwapUpdatesResponse,
+	error) {
+
+	res := <-f.results
+	return res.update, res.err
+}
+
+// TestRunSwapUpdateStreamClosesOnEOF asserts that a stream ending with
+// io.EOF closes updateChan without reconnecting, rather than looping
+// forever.
+func TestRunSwapUpdateStreamClosesOnEOF(t *testing.T) {
+	stream := newFakeSwapUpdateStream(swapUpdateStreamResult{err: io.EOF})
+
+	var reconnectCalls int
+	reconnect := func(ctx context.Context) (swapUpdateStream, error) {
+		reconnectCalls++
+		return stream, nil
+	}
+
+	updateChan := make(chan SwapUpdate)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runSwapUpdateStream(
+			context.Background(), updateChan, stream, reconnect,
+		)
+	}()
+
+	select {
+	case _, ok := <-updateChan:
+		require.False(t, ok, "expected updateChan to be closed")
+	case <-time.After(time.Second):
+		t.Fatal("updateChan was not closed after EOF")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runSwapUpdateStream did not return after EOF")
+	}
+
+	require.Zero(t, reconnectCalls)
+}
+
+// TestRunSwapUpdateStreamReconnectsOnTransientError asserts that a
+// non-EOF error triggers a reconnect, and updates keep flowing on the new
+// stream afterwards.
+func TestRunSwapUpdateStreamReconnectsOnTransientError(t *testing.T) {
+	prevWait := swapUpdateStreamRetryWait
+	swapUpdateStreamRetryWait = time.Millisecond
+	defer func() { swapUpdateStreamRetryWait = prevWait }()
+
+	firstStream := newFakeSwapUpdateStream(swapUpdateStreamResult{
+		err: errors.New("connection reset"),
+	})
+	secondStream := newFakeSwapUpdateStream(swapUpdateStreamResult{
+		update: &looprpc.SubscribeSwapUpdatesResponse{
+			State:     "terminal",
+			Timestamp: 1234,
+		},
+	})
+
+	var reconnectCalls int
+	reconnect := func(ctx context.Context) (swapUpdateStream, error) {
+		reconnectCalls++
+		return secondStream, nil
+	}
+
+	updateChan := make(chan SwapUpdate, 1)
+	go runSwapUpdateStream(
+		context.Background(), updateChan, firstStream, reconnect,
+	)
+
+	select {
+	case update := <-updateChan:
+		require.Equal(t, "terminal", update.State)
+	case <-time.After(time.Second):
+		t.Fatal("did not receive update from reconnected stream")
+	}
+
+	require.Equal(t, 1, reconnectCalls)
+}
+
+// TestSwapServerContextDialerHonorsContextCancellation asserts that the
+// SOCKS5 context dialer aborts a hung proxy handshake as soon as the dial
+// context is canceled, rather than blocking until the OS-level TCP timeout.
+func TestSwapServerContextDialerHonorsContextCancellation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// Accept the TCP connection but never speak the SOCKS5 protocol, so
+	// the handshake hangs until the dial context is canceled.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		<-time.After(5 * time.Second)
+	}()
+
+	dial, err := newSwapServerContextDialer(ln.Addr().String(), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 50*time.Millisecond,
+	)
+	defer cancel()
+
+	start := time.Now()
+	_, err = dial(ctx, "example.onion:1234")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,128 @@
+package loop
+
+import (
+	"context"
+	"encoding/hex"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// metricsNamespace is the Prometheus namespace shared by all swap server
+// client metrics.
+const metricsNamespace = "loop_client"
+
+// swapServerMetrics bundles the Prometheus collectors used to instrument
+// unary calls made to the swap server.
+type swapServerMetrics struct {
+	callCount    *prometheus.CounterVec
+	callDuration *prometheus.HistogramVec
+	callErrors   *prometheus.CounterVec
+}
+
+// newSwapServerMetrics creates the swap server client's collectors and
+// registers them with reg.
+func newSwapServerMetrics(reg prometheus.Registerer) *swapServerMetrics {
+	m := &swapServerMetrics{
+		callCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_calls_total",
+			Help: "Number of unary calls made to the swap " +
+				"server, labeled by method.",
+		}, []string{"method"}),
+		callDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_call_duration_seconds",
+			Help: "Latency of unary calls made to the swap " +
+				"server, labeled by method.",
+		}, []string{"method"}),
+		callErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rpc_call_errors_total",
+			Help: "Number of failed unary calls made to the " +
+				"swap server, labeled by method and gRPC " +
+				"status code.",
+		}, []string{"method", "code"}),
+	}
+
+	reg.MustRegister(m.callCount, m.callDuration, m.callErrors)
+
+	return m
+}
+
+// unaryInterceptor returns a grpc.UnaryClientInterceptor that records the
+// call count, latency and error code of every unary RPC made to the swap
+// server, so operators running many concurrent swaps can observe server
+// health.
+func (m *swapServerMetrics) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		m.callCount.WithLabelValues(method).Inc()
+		m.callDuration.WithLabelValues(method).Observe(
+			time.Since(start).Seconds(),
+		)
+		if err != nil {
+			m.callErrors.WithLabelValues(
+				method, status.Code(err).String(),
+			).Inc()
+		}
+
+		return err
+	}
+}
+
+// swapHashRequest is implemented by every looprpc request message that
+// carries a swap_hash field (ServerLoopOutRequest, ServerLoopInRequest,
+// SubscribeSwapUpdatesRequest), via the getter protoc-gen-go generates for
+// it.
+type swapHashRequest interface {
+	GetSwapHash() []byte
+}
+
+// tracingInterceptor returns a grpc.UnaryClientInterceptor that wraps every
+// unary call to the swap server in an OpenTelemetry span using tp. When the
+// request carries a swap hash, it's attached as a span attribute so a swap
+// can be correlated across client logs, lnd payment attempts and the swap
+// server.
+func tracingInterceptor(tp trace.TracerProvider) grpc.UnaryClientInterceptor {
+	tracer := tp.Tracer("github.com/lightninglabs/loop")
+
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption) error {
+
+		attrs := []attribute.KeyValue{
+			attribute.String("rpc.method", method),
+		}
+		if hashed, ok := req.(swapHashRequest); ok {
+			if hash := hashed.GetSwapHash(); len(hash) > 0 {
+				attrs = append(attrs, attribute.String(
+					"swap.hash", hex.EncodeToString(hash),
+				))
+			}
+		}
+
+		ctx, span := tracer.Start(
+			ctx, method, trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,133 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSwapHashRequest is a minimal swapHashRequest used to exercise the
+// tracing interceptor's swap hash attribute extraction.
+type fakeSwapHashRequest struct {
+	swapHash []byte
+}
+
+func (r fakeSwapHashRequest) GetSwapHash() []byte {
+	return r.swapHash
+}
+
+func noopInvoker(err error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+
+		return err
+	}
+}
+
+// TestUnaryInterceptorRecordsCallCountAndErrors asserts that the metrics
+// interceptor increments the call counter on every invocation and the error
+// counter, labeled by gRPC status code, only on failure.
+func TestUnaryInterceptorRecordsCallCountAndErrors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newSwapServerMetrics(reg)
+	interceptor := m.unaryInterceptor()
+
+	const method = "/looprpc.SwapServer/GetLoopOutQuote"
+
+	err := interceptor(
+		context.Background(), method, nil, nil, nil, noopInvoker(nil),
+	)
+	require.NoError(t, err)
+
+	wantErr := status.Error(codes.Unavailable, "down")
+	err = interceptor(
+		context.Background(), method, nil, nil, nil,
+		noopInvoker(wantErr),
+	)
+	require.Equal(t, wantErr, err)
+
+	require.Equal(
+		t, float64(2), testutil.ToFloat64(
+			m.callCount.WithLabelValues(method),
+		),
+	)
+	require.Equal(
+		t, float64(1), testutil.ToFloat64(
+			m.callErrors.WithLabelValues(
+				method, status.Code(wantErr).String(),
+			),
+		),
+	)
+}
+
+// TestTracingInterceptorAttachesSwapHash asserts that the tracing
+// interceptor tags the span with the swap hash when the request implements
+// swapHashRequest, and marks the span as an error when the call fails.
+func TestTracingInterceptorAttachesSwapHash(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+	)
+	interceptor := tracingInterceptor(tp)
+
+	req := fakeSwapHashRequest{swapHash: []byte{0xde, 0xad, 0xbe, 0xef}}
+	wantErr := errors.New("boom")
+
+	const method = "/looprpc.SwapServer/ServerLoopOutRequest"
+	err := interceptor(
+		context.Background(), method, req, nil, nil,
+		noopInvoker(wantErr),
+	)
+	require.Equal(t, wantErr, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+
+	span := spans[0]
+	require.Equal(t, otelcodes.Error, span.Status.Code)
+
+	attrs := span.Attributes
+	var gotSwapHash, gotMethod string
+	for _, attr := range attrs {
+		switch attr.Key {
+		case "swap.hash":
+			gotSwapHash = attr.Value.AsString()
+		case "rpc.method":
+			gotMethod = attr.Value.AsString()
+		}
+	}
+	require.Equal(t, "deadbeef", gotSwapHash)
+	require.Equal(t, method, gotMethod)
+}
+
+// TestTracingInterceptorSkipsSwapHashWhenAbsent asserts that requests not
+// implementing swapHashRequest don't cause a panic and simply aren't tagged
+// with a swap hash.
+func TestTracingInterceptorSkipsSwapHashWhenAbsent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	interceptor := tracingInterceptor(tp)
+
+	err := interceptor(
+		context.Background(), "/looprpc.SwapServer/GetLoopOutTerms",
+		struct{}{}, nil, nil, noopInvoker(nil),
+	)
+	require.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+
+	for _, attr := range spans[0].Attributes {
+		require.NotEqual(t, "swap.hash", string(attr.Key))
+	}
+}
@@ -0,0 +1,127 @@
+package loop
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultMaxRetries is the default number of retries a unary swap
+	// server call is allowed before giving up and returning the last
+	// error to the caller.
+	defaultMaxRetries = 3
+
+	// defaultRetryBaseDelay is the backoff delay used before the first
+	// retry attempt.
+	defaultRetryBaseDelay = 500 * time.Millisecond
+
+	// defaultRetryMaxDelay caps the exponential backoff delay between
+	// retries.
+	defaultRetryMaxDelay = 10 * time.Second
+
+	// idempotencyKeyHeader is the gRPC metadata header used to pass an
+	// idempotency key on mutating swap server calls, allowing the server
+	// to safely deduplicate a retried request.
+	idempotencyKeyHeader = "idempotency-key"
+)
+
+// retryConfig describes the retry policy applied to unary swap server calls.
+type retryConfig struct {
+	// maxRetries is the maximum number of retries attempted after the
+	// initial call.
+	maxRetries int
+
+	// baseDelay is the backoff delay before the first retry.
+	baseDelay time.Duration
+
+	// maxDelay caps the exponential backoff delay.
+	maxDelay time.Duration
+}
+
+// defaultRetryConfig is the retry policy used when newSwapServerClient isn't
+// given an explicit one.
+var defaultRetryConfig = retryConfig{
+	maxRetries: defaultMaxRetries,
+	baseDelay:  defaultRetryBaseDelay,
+	maxDelay:   defaultRetryMaxDelay,
+}
+
+// isRetryableError reports whether err is the result of a transient
+// condition, such as the swap server being temporarily unreachable, and is
+// therefore safe to retry. Errors like FailedPrecondition or InvalidArgument
+// indicate the request itself is bad and will never succeed, so they are not
+// retried.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// withRetry invokes call, retrying according to cfg whenever call returns a
+// retryable error. The backoff delay doubles with every attempt, up to
+// cfg.maxDelay, and is jittered so that multiple clients don't retry in
+// lockstep after a shared outage.
+func withRetry(ctx context.Context, cfg retryConfig, call func() error) error {
+	var err error
+	delay := cfg.baseDelay
+
+	for attempt := 0; attempt <= cfg.maxRetries; attempt++ {
+		err = call()
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+
+		if attempt == cfg.maxRetries {
+			break
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)+1))/2
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		delay *= 2
+		if delay > cfg.maxDelay {
+			delay = cfg.maxDelay
+		}
+	}
+
+	return err
+}
+
+// idempotencyKey deterministically derives an idempotency key for a mutating
+// swap server call from the swap's hash, so that NewLoopOutSwap and
+// NewLoopInSwap requests can be safely retried without the server creating a
+// duplicate swap.
+func idempotencyKey(swapHash lntypes.Hash) string {
+	sum := sha256.Sum256(swapHash[:])
+	return hex.EncodeToString(sum[:])
+}
+
+// outgoingCtxWithIdempotencyKey attaches the idempotency key derived from
+// swapHash to ctx as outgoing gRPC metadata.
+func outgoingCtxWithIdempotencyKey(ctx context.Context,
+	swapHash lntypes.Hash) context.Context {
+
+	return metadata.AppendToOutgoingContext(
+		ctx, idempotencyKeyHeader, idempotencyKey(swapHash),
+	)
+}
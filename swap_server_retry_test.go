@@ -0,0 +1,159 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lntypes"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestIsRetryableError asserts that only the gRPC status codes that
+// indicate a transient condition are classified as retryable.
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{
+			name:      "nil error",
+			err:       nil,
+			retryable: false,
+		},
+		{
+			name:      "unavailable is retryable",
+			err:       status.Error(codes.Unavailable, "down"),
+			retryable: true,
+		},
+		{
+			name:      "deadline exceeded is retryable",
+			err:       status.Error(codes.DeadlineExceeded, "timeout"),
+			retryable: true,
+		},
+		{
+			name:      "failed precondition is not retryable",
+			err:       status.Error(codes.FailedPrecondition, "bad"),
+			retryable: false,
+		},
+		{
+			name:      "invalid argument is not retryable",
+			err:       status.Error(codes.InvalidArgument, "bad"),
+			retryable: false,
+		},
+		{
+			name:      "non-grpc error is not retryable",
+			err:       errors.New("boom"),
+			retryable: false,
+		},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(
+				t, tc.retryable, isRetryableError(tc.err),
+			)
+		})
+	}
+}
+
+// TestWithRetrySucceedsAfterTransientErrors asserts that withRetry keeps
+// retrying a retryable error until the call succeeds.
+func TestWithRetrySucceedsAfterTransientErrors(t *testing.T) {
+	cfg := retryConfig{
+		maxRetries: 3,
+		baseDelay:  time.Millisecond,
+		maxDelay:   5 * time.Millisecond,
+	}
+
+	var attempts int
+	err := withRetry(context.Background(), cfg, func() error {
+		attempts++
+		if attempts < 3 {
+			return status.Error(codes.Unavailable, "down")
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+// TestWithRetryStopsOnNonRetryableError asserts that withRetry gives up
+// after the first attempt when the error isn't retryable.
+func TestWithRetryStopsOnNonRetryableError(t *testing.T) {
+	wantErr := status.Error(codes.InvalidArgument, "bad")
+
+	var attempts int
+	err := withRetry(
+		context.Background(), defaultRetryConfig, func() error {
+			attempts++
+			return wantErr
+		},
+	)
+	require.Equal(t, wantErr, err)
+	require.Equal(t, 1, attempts)
+}
+
+// TestWithRetryGivesUpAfterMaxRetries asserts that withRetry stops once
+// maxRetries has been exhausted, returning the last error seen.
+func TestWithRetryGivesUpAfterMaxRetries(t *testing.T) {
+	cfg := retryConfig{
+		maxRetries: 2,
+		baseDelay:  time.Millisecond,
+		maxDelay:   time.Millisecond,
+	}
+	wantErr := status.Error(codes.Unavailable, "down")
+
+	var attempts int
+	err := withRetry(context.Background(), cfg, func() error {
+		attempts++
+		return wantErr
+	})
+	require.Equal(t, wantErr, err)
+	require.Equal(t, cfg.maxRetries+1, attempts)
+}
+
+// TestWithRetryAbortsOnContextCancellation asserts that withRetry stops
+// waiting out its backoff delay as soon as the context is canceled.
+func TestWithRetryAbortsOnContextCancellation(t *testing.T) {
+	cfg := retryConfig{
+		maxRetries: 5,
+		baseDelay:  50 * time.Millisecond,
+		maxDelay:   50 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- withRetry(ctx, cfg, func() error {
+			return status.Error(codes.Unavailable, "down")
+		})
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errChan:
+		require.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("withRetry did not return after context cancellation")
+	}
+}
+
+// TestIdempotencyKeyIsDeterministic asserts that the idempotency key
+// derived for a swap hash is stable and distinct from that of other swaps.
+func TestIdempotencyKeyIsDeterministic(t *testing.T) {
+	hash := lntypes.Hash{1, 2, 3}
+	other := lntypes.Hash{4, 5, 6}
+
+	require.Equal(t, idempotencyKey(hash), idempotencyKey(hash))
+	require.NotEqual(t, idempotencyKey(hash), idempotencyKey(other))
+}